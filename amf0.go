@@ -0,0 +1,130 @@
+// amf0.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Minimal AMF0 (de)serialization — just enough to speak RTMP's connect /
+// createStream / publish command handshake. Strict AMF0, no AMF3 switch-over.
+const (
+	amf0Number    = 0x00
+	amf0Bool      = 0x01
+	amf0String    = 0x02
+	amf0Object    = 0x03
+	amf0Null      = 0x05
+	amf0ObjectEnd = 0x09
+)
+
+// amf0DecodeAll decodes a sequence of concatenated AMF0 values, as found in
+// an RTMP command message payload.
+func amf0DecodeAll(b []byte) ([]interface{}, error) {
+	var vals []interface{}
+	for len(b) > 0 {
+		v, rest, err := amf0Decode(b)
+		if err != nil {
+			return vals, err
+		}
+		vals = append(vals, v)
+		b = rest
+	}
+	return vals, nil
+}
+
+func amf0Decode(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, b, io.ErrUnexpectedEOF
+	}
+	switch b[0] {
+	case amf0Number:
+		if len(b) < 9 {
+			return nil, b, io.ErrUnexpectedEOF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), b[9:], nil
+	case amf0Bool:
+		if len(b) < 2 {
+			return nil, b, io.ErrUnexpectedEOF
+		}
+		return b[1] != 0, b[2:], nil
+	case amf0String:
+		if len(b) < 3 {
+			return nil, b, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, b, io.ErrUnexpectedEOF
+		}
+		return string(b[3 : 3+n]), b[3+n:], nil
+	case amf0Null:
+		return nil, b[1:], nil
+	case amf0Object:
+		b = b[1:]
+		obj := make(map[string]interface{})
+		for {
+			if len(b) >= 3 && b[0] == 0 && b[1] == 0 && b[2] == amf0ObjectEnd {
+				return obj, b[3:], nil
+			}
+			if len(b) < 2 {
+				return obj, b, io.ErrUnexpectedEOF
+			}
+			klen := int(binary.BigEndian.Uint16(b[0:2]))
+			if len(b) < 2+klen {
+				return obj, b, io.ErrUnexpectedEOF
+			}
+			key := string(b[2 : 2+klen])
+			b = b[2+klen:]
+			v, rest, err := amf0Decode(b)
+			if err != nil {
+				return obj, rest, err
+			}
+			obj[key] = v
+			b = rest
+		}
+	default:
+		return nil, nil, fmt.Errorf("amf0: unsupported type marker 0x%02x", b[0])
+	}
+}
+
+func amf0EncodeNumber(v float64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = amf0Number
+	binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+	return buf
+}
+
+func amf0EncodeString(s string) []byte {
+	buf := make([]byte, 3+len(s))
+	buf[0] = amf0String
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(s)))
+	copy(buf[3:], s)
+	return buf
+}
+
+func amf0EncodeNull() []byte {
+	return []byte{amf0Null}
+}
+
+// amf0EncodeObject encodes a flat object of string/number properties,
+// enough for the connect/publish reply objects RTMP clients expect.
+func amf0EncodeObject(props map[string]interface{}) []byte {
+	buf := []byte{amf0Object}
+	for k, v := range props {
+		key := make([]byte, 2+len(k))
+		binary.BigEndian.PutUint16(key[0:2], uint16(len(k)))
+		copy(key[2:], k)
+		buf = append(buf, key...)
+		switch val := v.(type) {
+		case string:
+			buf = append(buf, amf0EncodeString(val)...)
+		case float64:
+			buf = append(buf, amf0EncodeNumber(val)...)
+		case int:
+			buf = append(buf, amf0EncodeNumber(float64(val))...)
+		}
+	}
+	buf = append(buf, 0x00, 0x00, amf0ObjectEnd)
+	return buf
+}
@@ -0,0 +1,479 @@
+// auth.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jwtUploaderAlgFlag       = flag.String("jwt-uploader-alg", "HS256", `algorithm uploader bearer tokens are signed with: "HS256" or "RS256"`)
+	jwtUploaderSecretFlag    = flag.String("jwt-uploader-secret", os.Getenv("JWT_UPLOADER_SECRET"), "HMAC secret for HS256 uploader tokens")
+	jwtUploaderPublicKeyFlag = flag.String("jwt-uploader-public-key", "", "path to a PEM-encoded RSA public key for RS256 uploader tokens")
+	jwtPlaybackSecretFlag    = flag.String("jwt-playback-secret", os.Getenv("JWT_PLAYBACK_SECRET"), "HMAC secret the server signs playback tokens with")
+)
+
+// Uploaders authenticate with a bearer JWT issued by whatever identity
+// provider the deployment already has (HS256 shared secret or RS256 public
+// key, chosen with -jwt-uploader-alg). The server never mints these — it
+// only verifies them and checks the caller is allowed to upload.
+//
+// Playback is different: the server itself mints a short-lived, HS256
+// playback token per completed upload (see tusPatchHandler), embeds it in
+// every manifest URI it serves, and validates it on every /hls/ request.
+
+const (
+	playbackTokenTTL = 6 * time.Hour
+	revocationSweep  = 5 * time.Minute // how often expired jti entries are purged
+)
+
+// jwtHeader is the only part of a JWT header we care about.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+func b64URLEncode(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func b64URLDecode(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+
+// parseJWT splits token into its header, claims, and the signing input +
+// signature needed to verify it, without checking the signature itself.
+func parseJWT(token string) (header jwtHeader, claims map[string]interface{}, signingInput string, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		err = errors.New("jwt: malformed token")
+		return
+	}
+	headerJSON, err := b64URLDecode(parts[0])
+	if err != nil {
+		err = fmt.Errorf("jwt: decode header: %w", err)
+		return
+	}
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		err = fmt.Errorf("jwt: parse header: %w", err)
+		return
+	}
+	claimsJSON, err := b64URLDecode(parts[1])
+	if err != nil {
+		err = fmt.Errorf("jwt: decode claims: %w", err)
+		return
+	}
+	if err = json.Unmarshal(claimsJSON, &claims); err != nil {
+		err = fmt.Errorf("jwt: parse claims: %w", err)
+		return
+	}
+	sig, err = b64URLDecode(parts[2])
+	if err != nil {
+		err = fmt.Errorf("jwt: decode signature: %w", err)
+		return
+	}
+	signingInput = parts[0] + "." + parts[1]
+	return
+}
+
+// signHS256 encodes claims as a compact JWS using HMAC-SHA256.
+func signHS256(claims map[string]interface{}, secret []byte) (string, error) {
+	headerJSON, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64URLEncode(headerJSON) + "." + b64URLEncode(claimsJSON)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + b64URLEncode(mac.Sum(nil)), nil
+}
+
+// jwtVerifier checks a JWT's signature and returns its claims.
+type jwtVerifier interface {
+	Verify(token string) (map[string]interface{}, error)
+}
+
+type hmacVerifier struct{ secret []byte }
+
+func (v hmacVerifier) Verify(token string) (map[string]interface{}, error) {
+	header, claims, signingInput, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("jwt: expected HS256, got %s", header.Alg)
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("jwt: signature mismatch")
+	}
+	return claims, nil
+}
+
+type rsaVerifier struct{ pub *rsa.PublicKey }
+
+func (v rsaVerifier) Verify(token string) (map[string]interface{}, error) {
+	header, claims, signingInput, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("jwt: expected RS256, got %s", header.Alg)
+	}
+	sum := sha256.Sum256([]byte(signingInput))
+	if err := rsa.VerifyPKCS1v15(v.pub, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, fmt.Errorf("jwt: signature mismatch: %w", err)
+	}
+	return claims, nil
+}
+
+// newUploaderVerifier builds the jwtVerifier used for bearer tokens
+// presented by uploaders, per -jwt-uploader-alg.
+func newUploaderVerifier(alg, secret, publicKeyFile string) (jwtVerifier, error) {
+	switch strings.ToUpper(alg) {
+	case "HS256":
+		if secret == "" {
+			return nil, errors.New("jwt-uploader-secret (or JWT_UPLOADER_SECRET) is required for HS256")
+		}
+		return hmacVerifier{secret: []byte(secret)}, nil
+	case "RS256":
+		if publicKeyFile == "" {
+			return nil, errors.New("jwt-uploader-public-key is required for RS256")
+		}
+		pub, err := loadRSAPublicKey(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return rsaVerifier{pub: pub}, nil
+	default:
+		return nil, fmt.Errorf("unknown jwt-uploader-alg %q", alg)
+	}
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", path)
+	}
+	return pub, nil
+}
+
+// claimString and claimStrings pull typed values out of decoded JWT claims,
+// which json.Unmarshal always hands back as interface{}.
+func claimString(claims map[string]interface{}, key string) (string, bool) {
+	s, ok := claims[key].(string)
+	return s, ok
+}
+
+func claimStrings(claims map[string]interface{}, key string) []string {
+	raw, _ := claims[key].([]interface{})
+	out := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func claimExpired(claims map[string]interface{}) bool {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return true
+	}
+	return time.Now().After(time.Unix(int64(exp), 0))
+}
+
+// uploaderVerifier validates bearer tokens on upload endpoints; set once in
+// main() from -jwt-uploader-alg/-jwt-uploader-secret/-jwt-uploader-public-key.
+var uploaderVerifier jwtVerifier
+
+// requireUploadOp is the claim value an uploader's token must list under
+// "ops" to be allowed to create/append to uploads.
+const requireUploadOp = "upload"
+
+// requireLiveOp is the claim value a publisher's token must list under
+// "ops" to be allowed to publish a live stream (RTMP or WHIP).
+const requireLiveOp = "live"
+
+// jwtAuth is the uploader-facing counterpart of the old basicAuth: it
+// requires "Authorization: Bearer <jwt>", verifies it against
+// uploaderVerifier, and checks the token's "ops" claim permits uploads.
+func jwtAuth(next http.HandlerFunc) http.HandlerFunc {
+	return requireBearerOp(requireUploadOp, "upload", next)
+}
+
+// liveAuth is the live-publish counterpart of jwtAuth, gating WHIP's
+// POST/DELETE with the same bearer-token scheme instead of leaving live
+// ingest wide open.
+func liveAuth(next http.HandlerFunc) http.HandlerFunc {
+	return requireBearerOp(requireLiveOp, "live", next)
+}
+
+// subContextKey is the context key requireBearerOp stashes the verified
+// token's "sub" claim under, for handlers (e.g. whipHandler) that need to
+// bind ownership of the resource they're gating to the caller.
+type subContextKey struct{}
+
+// subFromContext returns the "sub" claim requireBearerOp verified for this
+// request, or "" if the request didn't go through it.
+func subFromContext(r *http.Request) string {
+	sub, _ := r.Context().Value(subContextKey{}).(string)
+	return sub
+}
+
+// requireBearerOp requires "Authorization: Bearer <jwt>", verifies it
+// against uploaderVerifier, and checks the token's "ops" claim lists op.
+// realm is used only for the WWW-Authenticate challenge.
+func requireBearerOp(op, realm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authz := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(authz, "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q`, realm))
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		claims, err := verifyOpToken(token, op)
+		if err != nil {
+			if errors.Is(err, errOpNotAuthorized) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+			} else {
+				http.Error(w, "invalid token: "+err.Error(), http.StatusUnauthorized)
+			}
+			return
+		}
+		sub, _ := claimString(claims, "sub")
+		next(w, r.WithContext(context.WithValue(r.Context(), subContextKey{}, sub)))
+	}
+}
+
+// errOpNotAuthorized wraps verifyOpToken's "wrong ops claim" case so
+// requireBearerOp can tell it apart from an outright invalid token and
+// answer 403 instead of 401, matching the old jwtAuth behavior.
+var errOpNotAuthorized = errors.New("token not authorized for")
+
+// verifyOpToken verifies token against uploaderVerifier and checks it is
+// unexpired, has a "sub", and lists op among its "ops" claim.
+func verifyOpToken(token, op string) (map[string]interface{}, error) {
+	claims, err := uploaderVerifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claimExpired(claims) {
+		return nil, errors.New("token expired")
+	}
+	if _, ok := claimString(claims, "sub"); !ok {
+		return nil, errors.New("token missing sub")
+	}
+	for _, o := range claimStrings(claims, "ops") {
+		if o == op {
+			return claims, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", errOpNotAuthorized, op)
+}
+
+// playbackSecret signs and verifies playback tokens; set once in main() from
+// -jwt-playback-secret/JWT_PLAYBACK_SECRET.
+var playbackSecret []byte
+
+// revocations tracks revoked playback tokens by jti until they'd have
+// expired anyway.
+var revocations = newRevocationList()
+
+// mintPlaybackToken issues a short-lived token scoped to one video, handed
+// back to the uploader alongside the HLS URL and embedded by hlsHandler into
+// every manifest URI it serves.
+func mintPlaybackToken(videoID, ip string) (string, error) {
+	if len(playbackSecret) == 0 {
+		return "", errors.New("playback signing key not configured")
+	}
+	claims := map[string]interface{}{
+		"video_id": videoID,
+		"exp":      time.Now().Add(playbackTokenTTL).Unix(),
+		"jti":      b64URLEncode(randomBytes(9)),
+	}
+	if ip != "" {
+		claims["ip"] = ip
+	}
+	return signHS256(claims, playbackSecret)
+}
+
+// verifyPlaybackToken checks a playback token's signature, expiry, video
+// scope, and revocation status. The caller checks ip itself, since only it
+// knows the request's remote address.
+func verifyPlaybackToken(token, videoID string) (map[string]interface{}, error) {
+	if len(playbackSecret) == 0 {
+		return nil, errors.New("playback signing key not configured")
+	}
+	claims, err := (hmacVerifier{secret: playbackSecret}).Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claimExpired(claims) {
+		return nil, errors.New("token expired")
+	}
+	if vid, _ := claimString(claims, "video_id"); vid != videoID {
+		return nil, errors.New("token not valid for this video")
+	}
+	if jti, ok := claimString(claims, "jti"); ok && revocations.isRevoked(jti) {
+		return nil, errors.New("token revoked")
+	}
+	return claims, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// revocationList is a small in-memory jti blocklist. Entries are dropped
+// once their token would have expired anyway, the same idle/expiry-driven
+// cleanup pattern as Manager's reapLoop and LiveManager's reapLoop.
+type revocationList struct {
+	mu  sync.Mutex
+	jti map[string]time.Time // jti -> original token expiry
+}
+
+func newRevocationList() *revocationList {
+	l := &revocationList{jti: make(map[string]time.Time)}
+	go l.sweepLoop()
+	return l
+}
+
+func (l *revocationList) revoke(jti string, exp time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.jti[jti] = exp
+}
+
+func (l *revocationList) isRevoked(jti string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.jti[jti]
+	return ok
+}
+
+// revokeHandler lets the uploader who owns a video invalidate one of its
+// playback tokens before it would otherwise expire, e.g. after taking the
+// video down. Gated by jwtAuth, so ownerOfVideo is checked against the
+// caller's own "sub" claim, not just that they hold *some* upload-op token.
+func revokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	claims, err := (hmacVerifier{secret: playbackSecret}).Verify(token)
+	if err != nil {
+		http.Error(w, "invalid token: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	jti, ok := claimString(claims, "jti")
+	if !ok {
+		http.Error(w, "token missing jti", http.StatusBadRequest)
+		return
+	}
+	videoID, ok := claimString(claims, "video_id")
+	if !ok {
+		http.Error(w, "token missing video_id", http.StatusBadRequest)
+		return
+	}
+	owner, ok := ownerOfVideo(videoID)
+	if !ok {
+		http.Error(w, "video not found", http.StatusNotFound)
+		return
+	}
+	if owner != subFromContext(r) {
+		http.Error(w, "not authorized to revoke this video's tokens", http.StatusForbidden)
+		return
+	}
+	exp := time.Now().Add(playbackTokenTTL)
+	if e, ok := claims["exp"].(float64); ok {
+		exp = time.Unix(int64(e), 0)
+	}
+	revocations.revoke(jti, exp)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownerOfVideo returns the "sub" claim of whoever created videoID, checking
+// tus uploads first and then live streams, or ok=false if videoID isn't
+// recognized by either.
+func ownerOfVideo(videoID string) (owner string, ok bool) {
+	if st, err := uploads.load(videoID); err == nil {
+		return st.Owner, true
+	}
+	if owner, live := liveManager.OwnerOf(videoID); live {
+		return owner, true
+	}
+	return "", false
+}
+
+func (l *revocationList) sweepLoop() {
+	ticker := time.NewTicker(revocationSweep)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		l.mu.Lock()
+		for jti, exp := range l.jti {
+			if now.After(exp) {
+				delete(l.jti, jti)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rewritePlaylistTokens appends "?token=..." (or "&token=..." if the URI
+// already has a query string) to every URI line in an m3u8 playlist, so
+// that following a master playlist into a rendition, or a rendition into
+// its segments, carries the same playback authorization forward.
+func rewritePlaylistTokens(playlist, token string) string {
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := "?"
+		if strings.Contains(line, "?") {
+			sep = "&"
+		}
+		lines[i] = line + sep + "token=" + token
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,149 @@
+// fragments.go
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// readBox reads one ISO-BMFF box (the 8-byte size+type header plus its
+// body) from r and returns the raw bytes and box type. Both the common
+// 32-bit size form and the 64-bit "largesize" form are read as one
+// contiguous block; a size of 0 (box runs to end of file) is rejected.
+func readBox(r io.Reader) (raw []byte, boxType string, err error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, "", err
+	}
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	boxType = string(hdr[4:8])
+
+	switch size {
+	case 0:
+		return nil, "", fmt.Errorf("mp4 box %q has unbounded size, not supported", boxType)
+	case 1:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, "", err
+		}
+		size64 := binary.BigEndian.Uint64(ext[:])
+		if size64 < 16 {
+			return nil, "", fmt.Errorf("mp4 box %q has invalid largesize %d", boxType, size64)
+		}
+		body := make([]byte, size64-16)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, "", err
+		}
+		raw = append(append(append([]byte{}, hdr[:]...), ext[:]...), body...)
+		return raw, boxType, nil
+	default:
+		if size < 8 {
+			return nil, "", fmt.Errorf("mp4 box %q has invalid size %d", boxType, size)
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, "", err
+		}
+		raw = append(append([]byte{}, hdr[:]...), body...)
+		return raw, boxType, nil
+	}
+}
+
+// readFragments consumes ffmpeg's fragmented-MP4 stdout: the leading
+// ftyp+moov become init.mp4, and every moof+mdat pair after that becomes
+// one LL-HLS part. Every partsPerSegment parts, the accumulated bytes are
+// finalized as a full segment and appended to the playlist.
+func (s *LiveStream) readFragments(stdout io.Reader) {
+	r := bufio.NewReaderSize(stdout, 256*1024)
+
+	var initBuf []byte
+	var segBuf []byte
+	sawInit := false
+
+	flushInit := func() error {
+		return os.WriteFile(filepath.Join(s.dir, "init.mp4"), initBuf, 0o644)
+	}
+
+	for {
+		raw, boxType, err := readBox(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("live %s: fragment read error: %v", s.Key, err)
+			}
+			return
+		}
+		s.touch()
+
+		switch boxType {
+		case "ftyp", "moov":
+			initBuf = append(initBuf, raw...)
+			if boxType == "moov" {
+				if err := flushInit(); err != nil {
+					log.Printf("live %s: write init.mp4: %v", s.Key, err)
+					return
+				}
+				sawInit = true
+			}
+		case "moof":
+			// buffered until its mdat arrives, so a part file is always a
+			// complete moof+mdat pair
+			segBuf = append(segBuf, raw...)
+		case "mdat":
+			if !sawInit {
+				continue // drop stray media before the init segment is ready
+			}
+			segBuf = append(segBuf, raw...)
+			if err := s.writePart(segBuf); err != nil {
+				log.Printf("live %s: write part: %v", s.Key, err)
+				return
+			}
+			segBuf = nil
+		default:
+			// ignore other top-level boxes (e.g. free, styp) ffmpeg may emit
+		}
+	}
+}
+
+// writePart writes one moof+mdat pair as the next partial segment, and
+// rolls it (and the parts before it) into a full segment once
+// partsPerSegment have accumulated.
+func (s *LiveStream) writePart(part []byte) error {
+	s.mu.Lock()
+	nextSegment := s.msn + 1
+	nextPart := s.part + 1
+	s.mu.Unlock()
+
+	partName := fmt.Sprintf("segment_%05d_part_%02d.m4s", nextSegment, nextPart)
+	if err := os.WriteFile(filepath.Join(s.dir, partName), part, 0o644); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	segFile := filepath.Join(s.dir, "segment_"+fmt.Sprintf("%05d", nextSegment)+".seg")
+	f, err := os.OpenFile(segFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		_, _ = f.Write(part)
+		f.Close()
+	}
+	s.part = nextPart
+
+	if s.part == partsPerSegment {
+		// finalize: rename the accumulated .seg to the real segment name
+		final := fmt.Sprintf("segment_%05d.m4s", nextSegment)
+		_ = os.Rename(segFile, filepath.Join(s.dir, final))
+		s.segments = append(s.segments, fmt.Sprintf("#EXTINF:%.3f,\n%s\n", (partDuration*partsPerSegment).Seconds(), final))
+		if len(s.segments) > liveSegmentHistory {
+			s.segments = s.segments[len(s.segments)-liveSegmentHistory:]
+		}
+		s.msn = nextSegment
+		s.part = 0
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,218 @@
+// hwaccel.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// vaapiDevice is the render node VAAPI encodes through.
+const vaapiDevice = "/dev/dri/renderD128"
+
+// hwAccelFlag lets operators force a specific backend, mainly for testing;
+// "auto" (the default) probes the host once at startup and falls back to
+// software if nothing usable is found.
+var hwAccelFlag = flag.String("hwaccel", "auto", `hardware encoder to use: "auto", "none", "vaapi", "nvenc", or "qsv"`)
+
+// selectedHWAccel is resolved once at startup by detectHWAccel and reused
+// for every transcode.
+var selectedHWAccel HWAccel
+
+// HWAccel builds the full ffmpeg argument list (everything after the
+// binary name) to transcode input into an HLS rendition at output (an
+// index.m3u8 path) for a given ladder rung. Implementations own everything
+// encoder-specific: device flags, filter graphs, and rate-control options.
+type HWAccel interface {
+	Name() string
+	Args(input, output string, rung Rung) []string
+}
+
+// software is the libx264 fallback used when no hardware encoder is
+// available or one hasn't been requested.
+type software struct{}
+
+func (software) Name() string { return "software" }
+
+func (software) Args(input, output string, rung Rung) []string {
+	return []string{
+		"-y",
+		"-i", input,
+		"-vf", fmt.Sprintf("scale=-2:%d", rung.Height),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-b:v", rung.VideoBitrate,
+		"-maxrate", rung.MaxBitrate,
+		"-bufsize", rung.BufSize,
+		"-c:a", "aac",
+		"-b:a", rung.AudioBitrate,
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", hlsSegmentTime,
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "temp_file",
+		"-hls_segment_filename", filepath.Join(filepath.Dir(output), "segment_%03d.ts"),
+		output,
+	}
+}
+
+// vaapiHWAccel drives Intel/AMD VAAPI encode through a render node.
+type vaapiHWAccel struct{ device string }
+
+func (v vaapiHWAccel) Name() string { return "vaapi" }
+
+func (v vaapiHWAccel) Args(input, output string, rung Rung) []string {
+	return []string{
+		"-y",
+		"-vaapi_device", v.device,
+		"-i", input,
+		"-vf", fmt.Sprintf("format=nv12,hwupload,scale_vaapi=-2:%d", rung.Height),
+		"-c:v", "h264_vaapi",
+		"-qp", "23",
+		"-b:v", rung.VideoBitrate,
+		"-maxrate", rung.MaxBitrate,
+		"-c:a", "aac",
+		"-b:a", rung.AudioBitrate,
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", hlsSegmentTime,
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "temp_file",
+		"-hls_segment_filename", filepath.Join(filepath.Dir(output), "segment_%03d.ts"),
+		output,
+	}
+}
+
+// nvencHWAccel drives NVIDIA NVENC encode.
+type nvencHWAccel struct{}
+
+func (nvencHWAccel) Name() string { return "nvenc" }
+
+func (nvencHWAccel) Args(input, output string, rung Rung) []string {
+	return []string{
+		"-y",
+		"-hwaccel", "cuda",
+		"-i", input,
+		"-vf", fmt.Sprintf("scale=-2:%d", rung.Height),
+		"-c:v", "h264_nvenc",
+		"-b:v", rung.VideoBitrate,
+		"-maxrate", rung.MaxBitrate,
+		"-bufsize", rung.BufSize,
+		"-c:a", "aac",
+		"-b:a", rung.AudioBitrate,
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", hlsSegmentTime,
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "temp_file",
+		"-hls_segment_filename", filepath.Join(filepath.Dir(output), "segment_%03d.ts"),
+		output,
+	}
+}
+
+// qsvHWAccel drives Intel Quick Sync Video encode.
+type qsvHWAccel struct{}
+
+func (qsvHWAccel) Name() string { return "qsv" }
+
+func (qsvHWAccel) Args(input, output string, rung Rung) []string {
+	return []string{
+		"-y",
+		"-init_hw_device", "qsv=hw",
+		"-filter_hw_device", "hw",
+		"-i", input,
+		"-vf", fmt.Sprintf("format=nv12,hwupload=extra_hw_frames=64,scale_qsv=-2:%d", rung.Height),
+		"-c:v", "h264_qsv",
+		"-b:v", rung.VideoBitrate,
+		"-maxrate", rung.MaxBitrate,
+		"-c:a", "aac",
+		"-b:a", rung.AudioBitrate,
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", hlsSegmentTime,
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "temp_file",
+		"-hls_segment_filename", filepath.Join(filepath.Dir(output), "segment_%03d.ts"),
+		output,
+	}
+}
+
+// detectHWAccel resolves which HWAccel implementation to use. A forced,
+// non-"auto" value is validated and returned outright (useful in tests and
+// on hosts where probing gets it wrong); "auto" probes the host once and
+// picks the first backend whose ffmpeg encoder exists and, for VAAPI and
+// NVENC, whose device is present (QSV is picked on its encoder alone),
+// falling back to software.
+func detectHWAccel(forced string) (HWAccel, error) {
+	switch forced {
+	case "none":
+		return software{}, nil
+	case "vaapi":
+		return vaapiHWAccel{device: vaapiDevice}, nil
+	case "nvenc":
+		return nvencHWAccel{}, nil
+	case "qsv":
+		return qsvHWAccel{}, nil
+	case "", "auto":
+		// fall through to probing below
+	default:
+		return nil, fmt.Errorf("unknown -hwaccel value %q", forced)
+	}
+
+	encoders, err := ffmpegEncoders()
+	if err != nil {
+		log.Printf("hwaccel: could not list ffmpeg encoders (%v), falling back to software", err)
+		return software{}, nil
+	}
+
+	if encoders["h264_vaapi"] && fileExists(vaapiDevice) {
+		return vaapiHWAccel{device: vaapiDevice}, nil
+	}
+	if encoders["h264_nvenc"] && nvidiaGPUPresent() {
+		return nvencHWAccel{}, nil
+	}
+	if encoders["h264_qsv"] {
+		return qsvHWAccel{}, nil
+	}
+	return software{}, nil
+}
+
+// ffmpegEncoders runs `ffmpeg -hide_banner -encoders` once and returns the
+// set of h264/hevc encoder names it reports.
+func ffmpegEncoders() (map[string]bool, error) {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, f := range strings.Fields(line) {
+			if strings.HasPrefix(f, "h264_") || strings.HasPrefix(f, "hevc_") {
+				found[f] = true
+			}
+		}
+	}
+	return found, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// nvidiaGPUPresent checks for an NVIDIA GPU via CUDA_VISIBLE_DEVICES or a
+// working nvidia-smi, either of which is enough signal that NVENC is worth
+// trying.
+func nvidiaGPUPresent() bool {
+	if os.Getenv("CUDA_VISIBLE_DEVICES") != "" {
+		return true
+	}
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return false
+	}
+	return exec.Command("nvidia-smi").Run() == nil
+}
@@ -0,0 +1,355 @@
+// live.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	liveDir            = "./storage/live"     // where live HLS output (fmp4 segments + playlists) is written
+	partDuration       = 200 * time.Millisecond // target duration of one LL-HLS partial segment
+	partsPerSegment    = 10                     // parts per full segment (~2s at partDuration)
+	liveSegmentHistory = 6                      // completed segments listed in the playlist; older segment and part files stay on disk until teardown
+	liveIdleTimeout    = 30 * time.Second        // torn down after this long without ingest data
+)
+
+// LiveStream is one active live ingest: an ffmpeg remux process plus the
+// LL-HLS segment/part bookkeeping the fragment reader and playlist writer
+// share.
+type LiveStream struct {
+	Key   string
+	Owner string // "sub" claim of the token that started this stream; see LiveManager.Start
+	dir   string
+	Token string // playback token scoped to Key, required by liveHandler on every read
+
+	stdin  io.WriteCloser
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	msn      int      // index of the last *completed* segment
+	part     int      // parts written into the in-progress segment
+	segments []string // EXTINF lines for the last liveSegmentHistory completed segments
+	closed   bool
+	err      error
+
+	lastData atomic.Int64 // unix seconds of the last byte ingested
+}
+
+func newLiveStream(key, dir string) *LiveStream {
+	s := &LiveStream{Key: key, dir: dir, msn: -1}
+	s.cond = sync.NewCond(&s.mu)
+	s.touch()
+	return s
+}
+
+func (s *LiveStream) touch() { s.lastData.Store(time.Now().Unix()) }
+
+func (s *LiveStream) idleSince() time.Duration {
+	return time.Since(time.Unix(s.lastData.Load(), 0))
+}
+
+// waitForPart blocks until segment msn's part-th partial segment exists (or
+// the whole segment msn is complete, when part is 0), the stream closes, or
+// timeout elapses. This backs the `_HLS_msn`/`_HLS_part` blocking playlist
+// reload query params.
+func (s *LiveStream) waitForPart(msn, part int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		// s.part counts parts of the in-progress segment s.msn+1
+		if s.msn >= msn || (part > 0 && s.msn+1 == msn && s.part >= part) {
+			return nil
+		}
+		if s.closed {
+			if s.err != nil {
+				return s.err
+			}
+			return fmt.Errorf("live stream ended")
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil // LL-HLS: serve what we have rather than error on timeout
+		}
+		timer := time.AfterFunc(remaining, s.cond.Broadcast)
+		s.cond.Wait()
+		timer.Stop()
+	}
+}
+
+// playlist renders the current LL-HLS media playlist: completed segments as
+// EXTINF entries, plus EXT-X-PART entries for the in-progress segment.
+// token is appended to every referenced URI (init.mp4, parts, segments) so
+// that a client following the playlist carries its playback authorization
+// forward, the same way rewritePlaylistTokens does for VOD manifests.
+func (s *LiveStream) playlist(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int((partDuration*partsPerSegment)/time.Second)+1)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partDuration.Seconds())
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", max(0, s.msn-len(s.segments)+1))
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4?token=%s\"\n", token)
+	for _, line := range s.segments {
+		extinf, filename, _ := strings.Cut(line, "\n")
+		filename = strings.TrimSuffix(filename, "\n")
+		fmt.Fprintf(&b, "%s\n%s?token=%s\n", extinf, filename, token)
+	}
+	for p := 1; p <= s.part; p++ {
+		fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"segment_%05d_part_%02d.m4s?token=%s\"\n", partDuration.Seconds(), s.msn+1, p, token)
+	}
+	return b.String()
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// LiveManager owns the set of active live ingests, keyed by stream key —
+// the same shape as Manager for on-demand VOD transcodes.
+type LiveManager struct {
+	mu      sync.Mutex
+	streams map[string]*LiveStream
+}
+
+func NewLiveManager() *LiveManager {
+	m := &LiveManager{streams: make(map[string]*LiveStream)}
+	go m.reapLoop()
+	return m
+}
+
+// Start begins ingest for streamKey: an ffmpeg process remuxes whatever's
+// written to the returned stream's stdin (raw FLV, see rtmp.go) into
+// fragmented MP4 on stdout, which readFragments turns into LL-HLS parts and
+// segments. If the key is already live under the same owner, the existing
+// stream is returned; if it's live under a different owner, Start refuses
+// rather than letting a second publisher hijack the broadcast.
+func (m *LiveManager) Start(streamKey, owner string) (*LiveStream, error) {
+	m.mu.Lock()
+	if s, ok := m.streams[streamKey]; ok {
+		m.mu.Unlock()
+		if s.Owner != owner {
+			return nil, fmt.Errorf("stream key %q is already live", streamKey)
+		}
+		return s, nil
+	}
+	m.mu.Unlock()
+
+	dir := filepath.Join(liveDir, streamKey)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir live dir: %w", err)
+	}
+
+	// Not IP-bound, same reasoning as the VOD playback token minted in
+	// tusPatchHandler: viewers, not the publisher, are the ones reading this
+	// stream back.
+	token, err := mintPlaybackToken(streamKey, "")
+	if err != nil {
+		return nil, fmt.Errorf("mint playback token: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-f", "flv", "-i", "pipe:0",
+		"-c", "copy",
+		"-movflags", "+frag_keyframe+empty_moov+default_base_moof",
+		"-frag_duration", strconv.Itoa(int(partDuration.Microseconds())),
+		"-f", "mp4", "pipe:1",
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	s := newLiveStream(streamKey, dir)
+	s.Owner = owner
+	s.stdin = stdin
+	s.cancel = cancel
+	s.Token = token
+
+	go s.readFragments(stdout)
+	go func() {
+		err := cmd.Wait()
+		s.mu.Lock()
+		s.closed = true
+		if err != nil {
+			s.err = fmt.Errorf("ffmpeg exited: %w", err)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	m.mu.Lock()
+	// another publish may have raced us and started the same key first
+	if existing, ok := m.streams[streamKey]; ok {
+		m.mu.Unlock()
+		_ = stdin.Close()
+		cancel()
+		go os.RemoveAll(dir)
+		if existing.Owner != owner {
+			return nil, fmt.Errorf("stream key %q is already live", streamKey)
+		}
+		return existing, nil
+	}
+	m.streams[streamKey] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+func (m *LiveManager) Get(streamKey string) (*LiveStream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.streams[streamKey]
+	return s, ok
+}
+
+// OwnerOf reports the "sub" claim that started streamKey, if it's live.
+func (m *LiveManager) OwnerOf(streamKey string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.streams[streamKey]
+	if !ok {
+		return "", false
+	}
+	return s.Owner, true
+}
+
+// Stop tears down streamKey, refusing if owner doesn't match whoever
+// started it — otherwise any holder of a valid live-op token could stop
+// someone else's broadcast by guessing its key.
+func (m *LiveManager) Stop(streamKey, owner string) error {
+	m.mu.Lock()
+	s, ok := m.streams[streamKey]
+	if ok && s.Owner != owner {
+		m.mu.Unlock()
+		return fmt.Errorf("stream key %q is not owned by this caller", streamKey)
+	}
+	delete(m.streams, streamKey)
+	m.mu.Unlock()
+	if ok {
+		_ = s.stdin.Close()
+		s.cancel()
+		go os.RemoveAll(s.dir)
+	}
+	return nil
+}
+
+// liveHandler serves a live stream's LL-HLS playlist and its init/part/
+// segment files, honoring the `_HLS_msn`/`_HLS_part` blocking reload
+// params with Cache-Control: no-cache throughout (live playlists must
+// never be cached by a CDN). Every request must carry the playback token
+// minted for this stream key in LiveManager.Start, the same scheme
+// hlsHandler uses for VOD playback.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/live/"), "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	streamKey, file := parts[0], parts[1]
+
+	s, ok := liveManager.Get(streamKey)
+	if !ok {
+		http.Error(w, "stream not live", http.StatusNotFound)
+		return
+	}
+
+	token := playbackToken(r)
+	if token == "" {
+		http.Error(w, "missing playback token", http.StatusUnauthorized)
+		return
+	}
+	claims, err := verifyPlaybackToken(token, streamKey)
+	if err != nil {
+		http.Error(w, "invalid playback token: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if boundIP, ok := claimString(claims, "ip"); ok && boundIP != clientIP(r) {
+		http.Error(w, "playback token not valid from this address", http.StatusForbidden)
+		return
+	}
+
+	if file == "index.m3u8" {
+		if msn, part, ok := parseBlockingReloadParams(r); ok {
+			_ = s.waitForPart(msn, part, 3*partsPerSegment*partDuration)
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = io.WriteString(w, s.playlist(token))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, filepath.Join(s.dir, file))
+}
+
+// parseBlockingReloadParams reads the LL-HLS `_HLS_msn`/`_HLS_part` query
+// params a client uses to ask the server to hold the playlist response
+// until that part exists.
+func parseBlockingReloadParams(r *http.Request) (msn, part int, ok bool) {
+	msnStr := r.URL.Query().Get("_HLS_msn")
+	if msnStr == "" {
+		return 0, 0, false
+	}
+	msn, err := strconv.Atoi(msnStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	part, _ = strconv.Atoi(r.URL.Query().Get("_HLS_part"))
+	return msn, part, true
+}
+
+// reapLoop tears down streams that stopped receiving ingest data (the
+// publisher disconnected without a clean teardown) after liveIdleTimeout,
+// removing their segment directories the same way Manager's reapLoop
+// reclaims JIT transcode dirs.
+func (m *LiveManager) reapLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		for key, s := range m.streams {
+			if s.idleSince() < liveIdleTimeout {
+				continue
+			}
+			log.Printf("live: reaping idle stream %q", key)
+			delete(m.streams, key)
+			_ = s.stdin.Close()
+			s.cancel()
+			go os.RemoveAll(s.dir)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -5,37 +5,99 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	storageDir      = "./storage"       // where each video's HLS output will live
-	maxUploadSize   = 1 << 30           // 1GB (adjust as needed)
-	ffmpegTimeout   = 10 * time.Minute  // how long we allow ffmpeg to run
-	basicAuthUser   = "admin"           // simple demo auth user
-	basicAuthPass   = "secret"          // demo auth password (change)
-	hlsSegmentTime  = "4"               // seconds per HLS segment
+	storageDir         = "./storage"      // where each video's HLS output will live
+	jitDir             = "./storage/.jit" // scratch space for in-progress on-demand transcodes
+	maxUploadSize      = 1 << 30          // 1GB (adjust as needed)
+	ffmpegTimeout      = 10 * time.Minute // how long we allow ffmpeg to run
+	hlsSegmentTime     = "4"              // seconds per HLS segment
+	segmentWaitTimeout = 20 * time.Second // how long a segment request blocks on the encoder
 )
 
+// manager is the process-wide JIT stream manager; every /hls/ request for a
+// profile's segments goes through it.
+var manager *Manager
+
 func main() {
+	flag.Parse()
+
+	hw, err := detectHWAccel(*hwAccelFlag)
+	if err != nil {
+		log.Fatalf("hwaccel: %v", err)
+	}
+	selectedHWAccel = hw
+	log.Printf("using %s encoder", selectedHWAccel.Name())
+
 	if err := os.MkdirAll(storageDir, 0o755); err != nil {
 		log.Fatalf("create storage dir: %v", err)
 	}
+	if err := os.MkdirAll(jitDir, 0o755); err != nil {
+		log.Fatalf("create jit dir: %v", err)
+	}
+
+	switch *storageBackendFlag {
+	case "local":
+		storage = NewLocalStorage(storageDir)
+	case "s3":
+		s3cfg, err := s3ConfigFromEnv()
+		if err != nil {
+			log.Fatalf("storage: %v", err)
+		}
+		storage = NewS3Storage(s3cfg)
+	default:
+		log.Fatalf("storage: unknown -storage value %q", *storageBackendFlag)
+	}
+
+	manager = NewManager(storageDir, jitDir, defaultLadder)
+	uploads = NewUploadStore(storageDir)
+
+	uv, err := newUploaderVerifier(*jwtUploaderAlgFlag, *jwtUploaderSecretFlag, *jwtUploaderPublicKeyFlag)
+	if err != nil {
+		log.Fatalf("jwt: %v", err)
+	}
+	uploaderVerifier = uv
+	if *jwtPlaybackSecretFlag == "" {
+		log.Fatalf("jwt: -jwt-playback-secret (or JWT_PLAYBACK_SECRET) is required")
+	}
+	playbackSecret = []byte(*jwtPlaybackSecretFlag)
+
+	if err := os.MkdirAll(liveDir, 0o755); err != nil {
+		log.Fatalf("create live dir: %v", err)
+	}
+	liveManager = NewLiveManager()
+	if err := startRTMPServer(); err != nil {
+		log.Fatalf("rtmp: %v", err)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/upload", basicAuth(uploadHandler))
+	// tus.io resumable upload protocol: POST creates, PATCH appends, HEAD
+	// queries progress. See tus.go.
+	mux.HandleFunc("/files", jwtAuth(tusCreateHandler))
+	mux.HandleFunc("/files/", jwtAuth(tusResumeHandler))
 	// Serve the HLS files (index.m3u8 + .ts) with caching headers
 	mux.Handle("/hls/", http.StripPrefix("/hls/", http.HandlerFunc(hlsHandler)))
+	// Live ingest: RTMP publishers land in liveManager directly (see
+	// rtmp.go, which checks the same "live" op token embedded in the
+	// stream key) and are the only ingest path that actually works today.
+	// /whip/ is registered so the DELETE teardown and auth wiring are in
+	// place, but POST always answers 501 — see negotiateWHIP in whip.go.
+	mux.HandleFunc("/whip/", liveAuth(whipHandler))
+	mux.HandleFunc("/live/", liveHandler)
+	mux.HandleFunc("/playback/revoke", jwtAuth(revokeHandler))
 
 	addr := ":8080"
 	log.Printf("listening on %s", addr)
@@ -59,93 +121,141 @@ func cors(h http.Handler) http.Handler {
 	})
 }
 
-// basicAuth is a tiny middleware for demo HTTP Basic Auth
-
-func basicAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != basicAuthUser || pass != basicAuthPass {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
+// hlsHandler serves HLS output for a video. master.m3u8 was written at
+// upload time; everything below it (a profile's index.m3u8 and its
+// segments) is transcoded on demand by manager and only exists in its temp
+// dir once requested. Every request must carry a playback token scoped to
+// this videoID (see mintPlaybackToken); manifests are rewritten on the way
+// out so that token carries forward into every URI they reference.
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	path := filepath.Clean(r.URL.Path)
+	if strings.Contains(path, "..") {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
 	}
-}
-
-// uploadHandler accepts multipart/form-data with a file field named "file".
-// It saves to a temp file, runs ffmpeg to convert to HLS and returns the HLS URL.
-
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	// limit request size to prevent resource exhaustion
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "could not parse multipart form: "+err.Error(), http.StatusBadRequest)
+	parts := strings.Split(strings.TrimLeft(path, "/"), "/")
+	if len(parts) < 2 {
+		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
+	videoID := parts[0]
 
-	file, fh, err := r.FormFile("file")
+	token := playbackToken(r)
+	if token == "" {
+		http.Error(w, "missing playback token", http.StatusUnauthorized)
+		return
+	}
+	claims, err := verifyPlaybackToken(token, videoID)
 	if err != nil {
-		http.Error(w, "file field 'file' required: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, "invalid playback token: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if boundIP, ok := claimString(claims, "ip"); ok && boundIP != clientIP(r) {
+		http.Error(w, "playback token not valid from this address", http.StatusForbidden)
 		return
 	}
-	defer file.Close()
 
-	// simple validation: allow mp4 and mov and mkv
-	if !isAllowedExt(fh.Filename) {
-		http.Error(w, "only mp4/mov/mkv allowed", http.StatusBadRequest)
+	if len(parts) == 2 && parts[1] == "master.m3u8" {
+		serveManifestFromStorage(w, r, videoIDKey(videoID, "master.m3u8"), token)
+		return
+	}
+	if len(parts) != 3 {
+		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
+	profile, file := parts[1], parts[2]
 
-	videoID := randomID(12)
-	outDir := filepath.Join(storageDir, videoID)
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		http.Error(w, "internal mkdir error: "+err.Error(), http.StatusInternalServerError)
+	s, err := manager.getOrStart(videoID, profile)
+	if err != nil {
+		http.Error(w, "transcode error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// save uploaded file to tmp path
-	tempPath := filepath.Join(outDir, "upload"+filepath.Ext(fh.Filename))
-	if err := saveUploadedFile(file, tempPath); err != nil {
-		http.Error(w, "save error: "+err.Error(), http.StatusInternalServerError)
+	if err := s.waitForFile(file, segmentWaitTimeout); err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
 		return
 	}
+	fsPath := filepath.Join(s.dir, file)
 
-	// convert to HLS via ffmpeg
-	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
-	defer cancel()
+	if strings.HasSuffix(file, ".m3u8") {
+		serveManifestFile(w, fsPath, token)
+		return
+	}
 
-	if err := convertToHLS(ctx, tempPath, outDir); err != nil {
-		log.Printf("ffmpeg error: %v", err)
-		http.Error(w, "transcode error: "+err.Error(), http.StatusInternalServerError)
+	// A remote backend (e.g. S3) is the durable copy once manager has
+	// uploaded it; redirect there instead of streaming it back through us.
+	// Segments don't need rewriting, so this is safe unlike for manifests.
+	if _, local := storage.(*LocalStorage); !local {
+		http.Redirect(w, r, storage.URL(s.storageKey(file)), http.StatusFound)
 		return
 	}
+	w.Header().Set("Cache-Control", cacheControlFor(file))
+	http.ServeFile(w, r, fsPath)
+}
 
-	// optionally remove uploaded file to save space
-	_ = os.Remove(tempPath)
+// clientIP returns the request's remote address with any port stripped, for
+// binding/checking a playback token's optional "ip" claim.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-	hlsURL := fmt.Sprintf("/hls/%s/index.m3u8", videoID)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"id":"%s","hls_url":"%s"}`, videoID, hlsURL)
+// playbackToken pulls the playback token off the request, either the
+// "token" query param or a "playback_token" cookie.
+func playbackToken(r *http.Request) string {
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+	if c, err := r.Cookie("playback_token"); err == nil {
+		return c.Value
+	}
+	return ""
 }
 
-// hlsHandler serves files from storage dir with Cache-Control for CDNs
-func hlsHandler(w http.ResponseWriter, r *http.Request) {
-	path := filepath.Clean(r.URL.Path)
-	if strings.Contains(path, "..") {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+// videoIDKey builds a Storage key for a top-level, per-video file such as
+// master.m3u8.
+func videoIDKey(videoID, name string) string {
+	return videoID + "/" + name
+}
+
+// serveManifestFromStorage fetches an m3u8 from storage (whichever backend
+// is configured), rewrites its URIs to carry token forward, and serves it.
+// Unlike segment files, manifests always go through us rather than being
+// redirected, since they need per-request rewriting.
+func serveManifestFromStorage(w http.ResponseWriter, r *http.Request, key, token string) {
+	f, err := storage.Get(key)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	fsPath := filepath.Join(storageDir, path)
-	// set caching headers for segments and manifests
-	if strings.HasSuffix(fsPath, ".ts") {
-		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-	} else if strings.HasSuffix(fsPath, ".m3u8") {
-		// small TTL for playlists (so ABR updates propagate)
-		w.Header().Set("Cache-Control", "public, max-age=5")
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, "read error: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
-	http.ServeFile(w, r, fsPath)
+	writeManifest(w, key, data, token)
+}
+
+// serveManifestFile reads an m3u8 straight off disk (a JIT stream's
+// rendition playlist, which always exists locally while the stream is
+// live regardless of storage backend) and serves it rewritten.
+func serveManifestFile(w http.ResponseWriter, fsPath, token string) {
+	data, err := os.ReadFile(fsPath)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeManifest(w, fsPath, data, token)
+}
+
+func writeManifest(w http.ResponseWriter, name string, data []byte, token string) {
+	w.Header().Set("Cache-Control", cacheControlFor(name))
+	w.Header().Set("Content-Type", contentTypeFor(name))
+	w.Write([]byte(rewritePlaylistTokens(string(data), token)))
 }
 
 // helpers
@@ -160,62 +270,172 @@ func isAllowedExt(filename string) bool {
 	}
 }
 
-func saveUploadedFile(src multipart.File, dest string) error {
-	out, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	_, err = io.Copy(out, src)
-	return err
-}
-
 func randomID(n int) string {
 	b := make([]byte, n)
 	_, _ = rand.Read(b)
 	return hex.EncodeToString(b)
 }
 
-// convertToHLS runs ffmpeg to produce HLS segments & index.m3u8 in outDir.
-// requires ffmpeg binary installed and reachable in PATH.
+// Rung describes one rendition in the adaptive bitrate ladder: a target
+// height plus the video/audio bitrates ffmpeg should encode it at.
+type Rung struct {
+	Name         string // used as the variant's subdirectory, e.g. "360p"
+	Height       int    // vertical resolution; width is derived to preserve aspect ratio
+	VideoBitrate string // e.g. "800k"
+	AudioBitrate string // e.g. "96k"
+	MaxBitrate   string // -maxrate
+	BufSize      string // -bufsize
+}
 
-func convertToHLS(ctx context.Context, inputPath, outDir string) error {
-	// ffmpeg args tuned for broad compatibility (VOD HLS)
-	// -c:v libx264: H.264
-	// -preset veryfast: faster encode (adjust for quality)
-	// -crf 23: quality/size tradeoff
-	// -c:a aac: audio codec
-	// -hls_time: segment duration
-	// -hls_segment_filename: where to write segments
-	outPattern := filepath.Join(outDir, "segment_%03d.ts")
-	indexPath := filepath.Join(outDir, "index.m3u8")
+// defaultLadder is the out-of-the-box bitrate ladder. Callers that need a
+// different set of rungs can build their own []Rung and pass it to
+// NewManager/selectRungs; prepareVideo always lists defaultLadder's rungs.
+var defaultLadder = []Rung{
+	{Name: "360p", Height: 360, VideoBitrate: "800k", AudioBitrate: "96k", MaxBitrate: "856k", BufSize: "1200k"},
+	{Name: "720p", Height: 720, VideoBitrate: "2800k", AudioBitrate: "128k", MaxBitrate: "2996k", BufSize: "4200k"},
+	{Name: "1080p", Height: 1080, VideoBitrate: "5000k", AudioBitrate: "128k", MaxBitrate: "5350k", BufSize: "7500k"},
+}
 
-	args := []string{
-		"-y", // overwrite
-		"-i", inputPath,
-		"-c:v", "libx264",
-		"-preset", "veryfast",
-		"-crf", "23",
-		"-c:a", "aac",
-		"-b:a", "128k",
-		"-ac", "2",
-		"-f", "hls",
-		"-hls_time", hlsSegmentTime,
-		"-hls_playlist_type", "vod",
-		"-hls_segment_filename", outPattern,
-		indexPath,
-	}
-
-	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
-	// optional: log ffmpeg stderr to server logs for debugging
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-
-	if err := cmd.Run(); err != nil {
-		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-			return fmt.Errorf("ffmpeg timeout reached: %w", err)
+// prepareVideo probes the uploaded source and writes the video's
+// master.m3u8 through storage (see writeMasterPlaylist), listing one variant per ladder rung that fits the source resolution.
+// Nothing is transcoded here — rungs are only encoded once a client asks
+// for them, by the stream Manager. requires ffprobe reachable in PATH.
+func prepareVideo(ctx context.Context, sourcePath, outDir string) error {
+	srcWidth, srcHeight, err := probeDimensions(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("ffprobe failed: %w", err)
+	}
+	rungs := selectRungs(defaultLadder, srcHeight)
+	return writeMasterPlaylist(outDir, srcWidth, srcHeight, rungs)
+}
+
+// selectRungs drops ladder rungs whose height exceeds srcHeight, to avoid
+// upscaling. If every rung would be dropped (the source is shorter than
+// even the smallest ladder rung), it falls back to a single rung built from
+// the source's own height instead of forcing the smallest ladder rung,
+// which would upscale exactly the case this function exists to avoid. It
+// reuses the smallest rung's bitrate settings, since those are the
+// cheapest and closest fit for a below-ladder source.
+func selectRungs(ladder []Rung, srcHeight int) []Rung {
+	var rungs []Rung
+	for _, r := range ladder {
+		if r.Height > srcHeight {
+			continue
 		}
-		return fmt.Errorf("ffmpeg failed: %w", err)
+		rungs = append(rungs, r)
+	}
+	if len(rungs) == 0 {
+		fallback := ladder[0]
+		fallback.Name = fmt.Sprintf("%dp", srcHeight)
+		fallback.Height = srcHeight
+		rungs = []Rung{fallback}
+	}
+	return rungs
+}
+
+// writeMasterPlaylist writes an HLS master playlist referencing each rung's
+// (not-yet-transcoded) index.m3u8 under its own profile subdirectory,
+// through storage so it lands wherever the configured backend puts HLS
+// output. cacheControlFor gives manifests a short TTL rather than the long
+// one segments get.
+func writeMasterPlaylist(outDir string, srcWidth, srcHeight int, rungs []Rung) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, r := range rungs {
+		bandwidth, err := estimateBandwidth(r)
+		if err != nil {
+			return err
+		}
+		width := evenWidth(srcWidth, srcHeight, r.Height)
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,NAME=%q\n", bandwidth, width, r.Height, r.Name)
+		fmt.Fprintf(&b, "%s/index.m3u8\n", r.Name)
+	}
+	videoID := filepath.Base(outDir)
+	return storage.Put(videoID+"/master.m3u8", strings.NewReader(b.String()))
+}
+
+// estimateBandwidth returns the EXT-X-STREAM-INF BANDWIDTH value (bits per
+// second) for a rung, from its max video rate plus its audio rate.
+func estimateBandwidth(r Rung) (int, error) {
+	video, err := parseBitrate(r.MaxBitrate)
+	if err != nil {
+		return 0, fmt.Errorf("parse video bitrate for rung %s: %w", r.Name, err)
+	}
+	audio, err := parseBitrate(r.AudioBitrate)
+	if err != nil {
+		return 0, fmt.Errorf("parse audio bitrate for rung %s: %w", r.Name, err)
+	}
+	return video + audio, nil
+}
+
+// parseBitrate turns ffmpeg-style bitrate strings like "800k" or "5M" into
+// bits per second.
+func parseBitrate(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty bitrate")
+	}
+	mult := 1
+	switch suffix := s[len(s)-1]; suffix {
+	case 'k', 'K':
+		mult = 1000
+		s = s[:len(s)-1]
+	case 'm', 'M':
+		mult = 1000 * 1000
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// evenWidth derives the rendition width for a target height, preserving the
+// source aspect ratio and rounding down to an even number (required by most
+// H.264 chroma subsampling).
+func evenWidth(srcWidth, srcHeight, targetHeight int) int {
+	w := int(float64(srcWidth) * float64(targetHeight) / float64(srcHeight))
+	if w%2 != 0 {
+		w--
+	}
+	return w
+}
+
+// rungArgs builds the ffmpeg args to transcode inputPath into a single HLS
+// rendition (segments + index.m3u8) at rung's settings, written to segDir,
+// using whichever encoder detectHWAccel selected at startup. Used by the
+// stream Manager to encode one profile at a time, on demand.
+func rungArgs(rung Rung, inputPath, segDir string) []string {
+	return selectedHWAccel.Args(inputPath, filepath.Join(segDir, "index.m3u8"), rung)
+}
+
+// probeDimensions uses ffprobe to read the resolution of the first video
+// stream in inputPath, so the bitrate ladder can skip rungs that would
+// upscale the source and the master playlist can advertise real widths.
+func probeDimensions(ctx context.Context, inputPath string) (width, height int, err error) {
+	args := []string{
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0:s=x",
+		inputPath,
+	}
+	out, err := exec.CommandContext(ctx, "ffprobe", args...).Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	dims := strings.Split(strings.TrimSpace(string(out)), "x")
+	if len(dims) != 2 {
+		return 0, 0, fmt.Errorf("unexpected ffprobe output %q", out)
+	}
+	width, err = strconv.Atoi(dims[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse ffprobe width output %q: %w", out, err)
+	}
+	height, err = strconv.Atoi(dims[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse ffprobe height output %q: %w", out, err)
 	}
-	return nil
+	return width, height, nil
 }
@@ -0,0 +1,32 @@
+// main_test.go
+package main
+
+import "testing"
+
+func TestSelectRungsAvoidsUpscale(t *testing.T) {
+	cases := []struct {
+		name      string
+		srcHeight int
+		want      []int // expected rung heights, in ladder order
+	}{
+		{"taller than whole ladder", 1080, []int{360, 720, 1080}},
+		{"between two rungs", 500, []int{360}},
+		{"shorter than every rung", 240, []int{240}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rungs := selectRungs(defaultLadder, c.srcHeight)
+			if len(rungs) != len(c.want) {
+				t.Fatalf("selectRungs(%d) = %v, want heights %v", c.srcHeight, rungs, c.want)
+			}
+			for i, r := range rungs {
+				if r.Height != c.want[i] {
+					t.Errorf("rung %d height = %d, want %d", i, r.Height, c.want[i])
+				}
+				if r.Height > c.srcHeight {
+					t.Errorf("rung %d height %d upscales a %dp source", i, r.Height, c.srcHeight)
+				}
+			}
+		})
+	}
+}
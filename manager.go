@@ -0,0 +1,306 @@
+// manager.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimeout is how long a JIT stream can go without a request before its
+// ffmpeg process is killed and its temp segments reclaimed.
+const idleTimeout = 60 * time.Second
+
+// pollInterval is how often the stream's watch loop checks for newly
+// written segments while ffmpeg is still running.
+const pollInterval = 200 * time.Millisecond
+
+// stream is a single ffmpeg process transcoding one videoID+profile
+// rendition into dir, started the first time a client asks for it.
+type stream struct {
+	videoID string
+	profile string
+	dir     string // where segments and index.m3u8 are written
+
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	ready     map[string]bool // filename -> present on disk AND upload to storage attempted
+	uploading map[string]bool // filename -> upload in flight, to dedupe across polls
+	done      bool            // ffmpeg has exited
+	failed    error           // non-nil if ffmpeg exited with an error
+
+	lastRequest atomic.Int64 // unix seconds of the last request touching this stream
+}
+
+func newStream(videoID, profile, dir string) *stream {
+	s := &stream{
+		videoID:   videoID,
+		profile:   profile,
+		dir:       dir,
+		ready:     make(map[string]bool),
+		uploading: make(map[string]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.touch()
+	return s
+}
+
+// storageKey is the Storage key a segment/playlist file in this stream is
+// uploaded and served under.
+func (s *stream) storageKey(name string) string {
+	return s.videoID + "/" + s.profile + "/" + name
+}
+
+func (s *stream) touch() {
+	s.lastRequest.Store(time.Now().Unix())
+}
+
+func (s *stream) idleSince() time.Duration {
+	return time.Since(time.Unix(s.lastRequest.Load(), 0))
+}
+
+// waitForFile blocks until name appears in dir, ffmpeg fails, or timeout
+// elapses. This is what lets a segment request arrive slightly ahead of
+// ffmpeg actually writing that segment.
+func (s *stream) waitForFile(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.ready[name] && s.failed == nil {
+		if s.done {
+			return fmt.Errorf("%s was never produced", name)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timed out waiting for %s", name)
+		}
+		timer := time.AfterFunc(remaining, s.cond.Broadcast)
+		s.cond.Wait()
+		timer.Stop()
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	return nil
+}
+
+// watch polls dir for new files and marks them ready, waking anyone blocked
+// in waitForFile. It returns once ffmpeg exits.
+func (s *stream) watch(cmd *exec.Cmd) {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			s.scan() // pick up anything written just before exit
+			s.mu.Lock()
+			s.done = true
+			if err != nil && !errors.Is(err, context.Canceled) {
+				s.failed = fmt.Errorf("ffmpeg failed: %w", err)
+			}
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return
+		case <-ticker.C:
+			s.scan()
+		}
+	}
+}
+
+// scan lists dir and uploads any file found for the first time, only then
+// marking it ready and waking anyone blocked in waitForFile. Polling stands
+// in for an fsnotify watch here since this module has no dependency manager
+// to vendor one with; a segment is "closed" for our purposes once ffmpeg
+// has moved on to writing the next one. That's safe to infer from
+// directory presence alone because every HWAccel.Args sets
+// "-hls_flags temp_file", so ffmpeg writes each segment/playlist to a
+// ".tmp" sibling and renames it into place only once the file is complete;
+// scan() ignores the ".tmp" name and only ever sees the final one appear
+// atomically. Each file is uploaded once, when scan first sees it; a
+// playlist that ffmpeg rewrites afterwards is not uploaded again.
+//
+// ready must not be set until upload has returned: hlsHandler redirects a
+// waiting request straight to storage.URL(...) for non-local backends, so
+// marking ready any earlier would let that redirect land before the PUT
+// that's supposed to back it.
+func (s *stream) scan() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	var fresh []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasSuffix(name, ".tmp") || s.ready[name] || s.uploading[name] {
+			continue
+		}
+		s.uploading[name] = true
+		fresh = append(fresh, name)
+	}
+	s.mu.Unlock()
+
+	for _, name := range fresh {
+		s.upload(name)
+		s.mu.Lock()
+		delete(s.uploading, name)
+		s.ready[name] = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// upload pushes a newly-produced segment or rendition playlist to storage
+// under this stream's videoID/profile prefix. Failures are logged rather
+// than surfaced. Playlists are still served from s.dir while the JIT stream
+// is alive; with a non-local backend hlsHandler redirects segment requests
+// to storage, so a segment whose upload failed is not servable there.
+func (s *stream) upload(name string) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		log.Printf("stream %s/%s: open %s for upload: %v", s.videoID, s.profile, name, err)
+		return
+	}
+	defer f.Close()
+	if err := storage.Put(s.storageKey(name), f); err != nil {
+		log.Printf("stream %s/%s: upload %s: %v", s.videoID, s.profile, name, err)
+	}
+}
+
+// Manager owns the set of live JIT transcodes, keyed by videoID+profile.
+// Mirrors the go-vod approach: nothing is transcoded until a client asks
+// for it, and idle renditions are torn down after idleTimeout.
+type Manager struct {
+	sourceDir string // uploaded originals, one "source.*" file per videoID
+	tmpDir    string // scratch space for in-flight transcodes
+	ladder    []Rung
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// NewManager starts a Manager and its background reaper.
+func NewManager(sourceDir, tmpDir string, ladder []Rung) *Manager {
+	m := &Manager{
+		sourceDir: sourceDir,
+		tmpDir:    tmpDir,
+		ladder:    ladder,
+		streams:   make(map[string]*stream),
+	}
+	go m.reapLoop()
+	return m
+}
+
+func streamKey(videoID, profile string) string {
+	return videoID + "+" + profile
+}
+
+// getOrStart returns the stream for videoID+profile, spawning ffmpeg the
+// first time it's requested.
+func (m *Manager) getOrStart(videoID, profile string) (*stream, error) {
+	key := streamKey(videoID, profile)
+
+	m.mu.Lock()
+	if s, ok := m.streams[key]; ok {
+		m.mu.Unlock()
+		s.touch()
+		return s, nil
+	}
+	m.mu.Unlock()
+
+	rung, err := m.rungFor(profile)
+	if err != nil {
+		return nil, err
+	}
+	sourcePath, err := m.sourcePath(videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	segDir := filepath.Join(m.tmpDir, key)
+	if err := os.MkdirAll(segDir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir stream dir: %w", err)
+	}
+	s := newStream(videoID, profile, segDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", rungArgs(rung, sourcePath, segDir)...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+	go s.watch(cmd)
+
+	m.mu.Lock()
+	// another request may have raced us and started the same stream first
+	if existing, ok := m.streams[key]; ok {
+		m.mu.Unlock()
+		cancel()
+		existing.touch()
+		return existing, nil
+	}
+	m.streams[key] = s
+	m.mu.Unlock()
+
+	return s, nil
+}
+
+func (m *Manager) rungFor(profile string) (Rung, error) {
+	for _, r := range m.ladder {
+		if r.Name == profile {
+			return r, nil
+		}
+	}
+	return Rung{}, fmt.Errorf("unknown profile %q", profile)
+}
+
+// sourcePath finds the uploaded original for videoID, whatever extension it
+// was saved with (see finishUpload).
+func (m *Manager) sourcePath(videoID string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(m.sourceDir, videoID, "source.*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no source video for %q", videoID)
+	}
+	return matches[0], nil
+}
+
+// reapLoop kills and removes streams nobody has requested from in
+// idleTimeout, so idle videos don't hold an ffmpeg process open forever.
+func (m *Manager) reapLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		for key, s := range m.streams {
+			if s.idleSince() < idleTimeout {
+				continue
+			}
+			s.cancel()
+			delete(m.streams, key)
+			go os.RemoveAll(s.dir)
+		}
+		m.mu.Unlock()
+	}
+}
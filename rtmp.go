@@ -0,0 +1,405 @@
+// rtmp.go
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// rtmpAddr is the TCP listen address for the RTMP ingest server.
+const rtmpAddr = ":1935"
+
+// defaultChunkSize is the RTMP chunk size we announce to publishers in our
+// reply to their connect command, generous enough that our own control/command
+// messages never need to be split across chunks.
+const defaultChunkSize = 4096
+
+// RTMP message type IDs we care about (ITU/Adobe RTMP spec).
+const (
+	rtmpMsgSetChunkSize  = 1
+	rtmpMsgWindowAckSize = 5
+	rtmpMsgSetPeerBW     = 6
+	rtmpMsgAudio         = 8
+	rtmpMsgVideo         = 9
+	rtmpMsgAMF0Data      = 18
+	rtmpMsgAMF0Command   = 20
+)
+
+// liveManager is the process-wide live-ingest manager; the RTMP listener
+// publishes into it, and the WHIP endpoint's DELETE stops streams in it.
+var liveManager *LiveManager
+
+// startRTMPServer listens for RTMP publishers on rtmpAddr until the process
+// exits. Each connection is handled in its own goroutine.
+func startRTMPServer() error {
+	ln, err := net.Listen("tcp", rtmpAddr)
+	if err != nil {
+		return fmt.Errorf("rtmp listen: %w", err)
+	}
+	log.Printf("rtmp listening on %s", rtmpAddr)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("rtmp accept error: %v", err)
+				continue
+			}
+			go handleRTMPConn(conn)
+		}
+	}()
+	return nil
+}
+
+// rtmpChunkStream tracks the running message-header state RTMP lets a
+// publisher omit on fmt 1/2/3 chunks, per chunk stream ID.
+type rtmpChunkStream struct {
+	msgLength   uint32
+	msgTypeID   byte
+	msgStreamID uint32
+	timestamp   uint32
+	buf         []byte // partial message payload accumulated so far
+}
+
+// handleRTMPConn performs the handshake, then demuxes chunks until the
+// publisher disconnects. Only the common path (connect, createStream,
+// publish, then audio/video/AMF0-data messages) is handled — aggregate
+// messages and AMF3 are not.
+func handleRTMPConn(conn net.Conn) {
+	defer conn.Close()
+
+	if err := rtmpHandshake(conn); err != nil {
+		log.Printf("rtmp handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	chunkSize := uint32(128) // RTMP default until a Set Chunk Size message changes it
+	streams := make(map[uint32]*rtmpChunkStream)
+
+	var streamKey, owner string
+	var live *LiveStream
+	var flvStarted bool
+
+	for {
+		fmtByte, csid, err := readBasicHeader(r)
+		if err != nil {
+			break
+		}
+		cs, ok := streams[csid]
+		if !ok {
+			cs = &rtmpChunkStream{}
+			streams[csid] = cs
+		}
+		if err := readMessageHeader(r, fmtByte, cs); err != nil {
+			log.Printf("rtmp %s: message header: %v", conn.RemoteAddr(), err)
+			break
+		}
+
+		remaining := int(cs.msgLength) - len(cs.buf)
+		if remaining < 0 {
+			remaining = 0
+		}
+		toRead := remaining
+		if toRead > int(chunkSize) {
+			toRead = int(chunkSize)
+		}
+		chunk := make([]byte, toRead)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			break
+		}
+		cs.buf = append(cs.buf, chunk...)
+		if len(cs.buf) < int(cs.msgLength) {
+			continue // message spans more chunks
+		}
+
+		payload := cs.buf
+		cs.buf = nil
+		typeID := cs.msgTypeID
+
+		switch typeID {
+		case rtmpMsgSetChunkSize:
+			if len(payload) >= 4 {
+				chunkSize = binary.BigEndian.Uint32(payload[:4])
+			}
+		case rtmpMsgAMF0Command:
+			key, sub, err := handleRTMPCommand(conn, payload)
+			if err != nil {
+				log.Printf("rtmp %s: command: %v", conn.RemoteAddr(), err)
+				return
+			}
+			if key != "" {
+				streamKey, owner = key, sub
+				live, err = liveManager.Start(streamKey, owner)
+				if err != nil {
+					log.Printf("rtmp %s: start live stream: %v", conn.RemoteAddr(), err)
+					return
+				}
+			}
+		case rtmpMsgAudio, rtmpMsgVideo, rtmpMsgAMF0Data:
+			if live == nil {
+				continue // media arriving before publish() is unexpected; drop it
+			}
+			if !flvStarted {
+				if _, err := live.stdin.Write(flvHeader); err != nil {
+					log.Printf("rtmp %s: write flv header: %v", conn.RemoteAddr(), err)
+					return
+				}
+				flvStarted = true
+			}
+			tag := flvTag(typeID, cs.timestamp, payload)
+			if _, err := live.stdin.Write(tag); err != nil {
+				log.Printf("rtmp %s: write flv tag: %v", conn.RemoteAddr(), err)
+				return
+			}
+			live.touch()
+		}
+	}
+
+	if streamKey != "" {
+		if err := liveManager.Stop(streamKey, owner); err != nil {
+			log.Printf("rtmp %s: stop live stream: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// readBasicHeader reads an RTMP chunk basic header (1-3 bytes) and returns
+// the chunk format (0-3) and chunk stream ID.
+func readBasicHeader(r *bufio.Reader) (fmtByte byte, csid uint32, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	fmtByte = b >> 6
+	csid = uint32(b & 0x3f)
+	switch csid {
+	case 0:
+		b2, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		csid = uint32(b2) + 64
+	case 1:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		csid = uint32(ext[0]) + uint32(ext[1])*256 + 64
+	}
+	return fmtByte, csid, nil
+}
+
+// readMessageHeader reads the fmt-dependent message header and updates cs
+// in place (fmt 3 carries no header at all — everything is inherited).
+func readMessageHeader(r *bufio.Reader, fmtByte byte, cs *rtmpChunkStream) error {
+	if fmtByte == 3 {
+		return nil
+	}
+
+	var ts [3]byte
+	if _, err := io.ReadFull(r, ts[:]); err != nil {
+		return err
+	}
+	timestamp := uint32(ts[0])<<16 | uint32(ts[1])<<8 | uint32(ts[2])
+
+	if fmtByte <= 1 {
+		var lt [4]byte
+		if _, err := io.ReadFull(r, lt[:3]); err != nil {
+			return err
+		}
+		cs.msgLength = uint32(lt[0])<<16 | uint32(lt[1])<<8 | uint32(lt[2])
+		typeID, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		cs.msgTypeID = typeID
+	}
+	if fmtByte == 0 {
+		var sid [4]byte
+		if _, err := io.ReadFull(r, sid[:]); err != nil {
+			return err
+		}
+		cs.msgStreamID = binary.LittleEndian.Uint32(sid[:])
+	}
+
+	if timestamp == 0xFFFFFF {
+		var ext [4]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return err
+		}
+		timestamp = binary.BigEndian.Uint32(ext[:])
+	}
+	if fmtByte == 0 {
+		cs.timestamp = timestamp
+	} else {
+		cs.timestamp += timestamp
+	}
+	return nil
+}
+
+// handleRTMPCommand decodes one AMF0 command message and replies as
+// needed. It returns the publish stream name and the publishing token's
+// "sub" claim once the client issues publish(), so the caller can bind the
+// stream to that owner before feeding media into the live manager.
+func handleRTMPCommand(conn net.Conn, payload []byte) (streamKey, owner string, err error) {
+	vals, err := amf0DecodeAll(payload)
+	if err != nil || len(vals) == 0 {
+		return "", "", fmt.Errorf("decode command: %w", err)
+	}
+	name, _ := vals[0].(string)
+	var txID float64
+	if len(vals) > 1 {
+		txID, _ = vals[1].(float64)
+	}
+
+	switch name {
+	case "connect":
+		if err := writeChunk(conn, 2, 0, rtmpMsgSetChunkSize, 0, u32be(defaultChunkSize)); err != nil {
+			return "", "", err
+		}
+		if err := writeChunk(conn, 2, 0, rtmpMsgWindowAckSize, 0, u32be(2500000)); err != nil {
+			return "", "", err
+		}
+		if err := writeChunk(conn, 2, 0, rtmpMsgSetPeerBW, 0, append(u32be(2500000), 2)); err != nil {
+			return "", "", err
+		}
+		reply := append([]byte{}, amf0EncodeString("_result")...)
+		reply = append(reply, amf0EncodeNumber(txID)...)
+		reply = append(reply, amf0EncodeObject(map[string]interface{}{"fmsVer": "FMS/3,0,1,123", "capabilities": 31})...)
+		reply = append(reply, amf0EncodeObject(map[string]interface{}{
+			"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.",
+		})...)
+		return "", "", writeChunk(conn, 3, 0, rtmpMsgAMF0Command, 0, reply)
+
+	case "createStream":
+		reply := append([]byte{}, amf0EncodeString("_result")...)
+		reply = append(reply, amf0EncodeNumber(txID)...)
+		reply = append(reply, amf0EncodeNull()...)
+		reply = append(reply, amf0EncodeNumber(1)...) // stream ID
+		return "", "", writeChunk(conn, 3, 0, rtmpMsgAMF0Command, 0, reply)
+
+	case "publish":
+		// args: command, txID, null, streamName, publishType
+		if len(vals) < 4 {
+			return "", "", fmt.Errorf("publish: missing stream name")
+		}
+		raw, _ := vals[3].(string)
+		if raw == "" {
+			return "", "", fmt.Errorf("publish: empty stream name")
+		}
+		// Publishers embed their live-op bearer token as
+		// "{streamKey}?token={jwt}" in the stream name, the same shape
+		// WHIP takes it as a header and hlsHandler takes it as a query
+		// param — RTMP has no header of its own to carry it in.
+		key, token, ok := strings.Cut(raw, "?token=")
+		if !ok || key == "" || token == "" {
+			return "", "", fmt.Errorf("publish: missing ?token=<jwt> in stream name")
+		}
+		claims, err := verifyOpToken(token, requireLiveOp)
+		if err != nil {
+			return "", "", fmt.Errorf("publish: %w", err)
+		}
+		sub, _ := claimString(claims, "sub")
+		if existingOwner, live := liveManager.OwnerOf(key); live && existingOwner != sub {
+			return "", "", fmt.Errorf("publish: stream key %q is already live", key)
+		}
+		reply := append([]byte{}, amf0EncodeString("onStatus")...)
+		reply = append(reply, amf0EncodeNumber(0)...)
+		reply = append(reply, amf0EncodeNull()...)
+		reply = append(reply, amf0EncodeObject(map[string]interface{}{
+			"level": "status", "code": "NetStream.Publish.Start", "description": "Publishing " + key,
+		})...)
+		if err := writeChunk(conn, 3, 0, rtmpMsgAMF0Command, 1, reply); err != nil {
+			return "", "", err
+		}
+		return key, sub, nil
+
+	default:
+		// releaseStream, FCPublish, and friends: no reply needed for a
+		// minimal server, OBS/ffmpeg proceed regardless
+		return "", "", nil
+	}
+}
+
+// writeChunk writes a single, unsplit RTMP chunk (fmt 0, small csid). Every
+// message we send as a server (control + command replies) fits comfortably
+// under defaultChunkSize, so multi-chunk splitting is never needed here.
+func writeChunk(w io.Writer, csid uint32, timestamp uint32, typeID byte, streamID uint32, payload []byte) error {
+	if csid >= 64 {
+		return fmt.Errorf("writeChunk: csid %d needs an extended basic header, not implemented", csid)
+	}
+	hdr := make([]byte, 12)
+	hdr[0] = byte(csid)
+	hdr[1], hdr[2], hdr[3] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp)
+	length := len(payload)
+	hdr[4], hdr[5], hdr[6] = byte(length>>16), byte(length>>8), byte(length)
+	hdr[7] = typeID
+	binary.LittleEndian.PutUint32(hdr[8:12], streamID)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func u32be(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// flvHeader precedes the first FLV tag sent to ffmpeg: signature, version,
+// audio+video flag, header size, and an initial PreviousTagSize0 of 0.
+var flvHeader = []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+
+// flvTag wraps one RTMP audio/video/data payload as an FLV tag (including
+// its trailing PreviousTagSize), so a sequence of tags is a valid FLV
+// stream ffmpeg can demux with `-f flv`.
+func flvTag(tagType byte, timestamp uint32, payload []byte) []byte {
+	tag := make([]byte, 11+len(payload)+4)
+	tag[0] = tagType
+	n := len(payload)
+	tag[1], tag[2], tag[3] = byte(n>>16), byte(n>>8), byte(n)
+	tag[4], tag[5], tag[6] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	// tag[8:11] stream ID, always 0
+	copy(tag[11:], payload)
+	binary.BigEndian.PutUint32(tag[11+n:], uint32(11+n))
+	return tag
+}
+
+// rtmpHandshake performs the plain (unencrypted) RTMP handshake: C0+C1 in,
+// S0+S1+S2 out, C2 in. We don't validate the digest scheme publishers use
+// for RTMPE — OBS and ffmpeg both fall back to simple handshakes happily
+// when the server doesn't challenge them.
+func rtmpHandshake(conn net.Conn) error {
+	c0c1 := make([]byte, 1537)
+	if _, err := io.ReadFull(conn, c0c1); err != nil {
+		return fmt.Errorf("read c0+c1: %w", err)
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+1536+1536)
+	s0s1s2[0] = 3
+	if _, err := rand.Read(s0s1s2[1 : 1+1536]); err != nil {
+		return err
+	}
+	// echo the client's C1 back as S2, as the spec allows for a simple handshake
+	copy(s0s1s2[1+1536:], c0c1[1:])
+	if _, err := conn.Write(s0s1s2); err != nil {
+		return fmt.Errorf("write s0+s1+s2: %w", err)
+	}
+
+	c2 := make([]byte, 1536)
+	if _, err := io.ReadFull(conn, c2); err != nil {
+		return fmt.Errorf("read c2: %w", err)
+	}
+	return nil
+}
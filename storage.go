@@ -0,0 +1,431 @@
+// storage.go
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage abstracts where HLS output (manifests + segments) lives, so the
+// JIT Manager and the upload pipeline don't care whether they're writing to
+// local disk or an S3-compatible bucket. LocalStorage preserves today's
+// behavior; S3Storage lets any node serve any video by putting output
+// somewhere every node can reach.
+type Storage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+	URL(key string) string
+}
+
+// storage is the process-wide backend every HLS read/write goes through.
+var storage Storage
+
+// storageBackendFlag picks which Storage implementation main() wires up.
+var storageBackendFlag = flag.String("storage", "local", `HLS output backend: "local" or "s3"`)
+
+// contentTypeFor and cacheControlFor centralize the per-extension headers
+// used to already be hard-coded in hlsHandler. S3Storage stores both on
+// every object it uploads; LocalStorage does not use them, and hlsHandler
+// sets them itself on what it serves from local disk.
+func contentTypeFor(key string) string {
+	switch filepath.Ext(key) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".mp4", ".m4s":
+		return "video/mp4"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func cacheControlFor(key string) string {
+	switch filepath.Ext(key) {
+	case ".m3u8":
+		// short TTL: ABR/LL-HLS updates need to propagate quickly
+		return "public, max-age=5"
+	default:
+		return "public, max-age=31536000, immutable"
+	}
+}
+
+// LocalStorage stores HLS output as plain files under root, exactly like
+// the server did before a Storage abstraction existed.
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) *LocalStorage { return &LocalStorage{root: root} }
+
+func (s *LocalStorage) path(key string) string { return filepath.Join(s.root, filepath.FromSlash(key)) }
+
+func (s *LocalStorage) Put(key string, r io.Reader) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *LocalStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	root := s.path(prefix)
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+// URL returns the path hlsHandler already serves local files from.
+func (s *LocalStorage) URL(key string) string { return "/hls/" + key }
+
+// s3Config holds the credentials and endpoint S3Storage signs requests
+// with. Endpoint is configurable so MinIO/R2/any S3-compatible store works,
+// not just AWS.
+type s3Config struct {
+	bucket    string
+	region    string
+	endpoint  string // e.g. "https://s3.us-east-1.amazonaws.com" or a MinIO/R2 URL
+	accessKey string
+	secretKey string
+}
+
+// s3ConfigFromEnv reads S3 settings the conventional way (env vars), so
+// there's nothing S3-specific to wire through flags.
+func s3ConfigFromEnv() (s3Config, error) {
+	cfg := s3Config{
+		bucket:    os.Getenv("S3_BUCKET"),
+		region:    os.Getenv("S3_REGION"),
+		endpoint:  os.Getenv("S3_ENDPOINT"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if cfg.bucket == "" {
+		return cfg, errors.New("S3_BUCKET is required when -storage=s3")
+	}
+	if cfg.region == "" {
+		cfg.region = "us-east-1"
+	}
+	if cfg.endpoint == "" {
+		cfg.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.region)
+	}
+	return cfg, nil
+}
+
+// presignTTL is how long a presigned segment/manifest URL stays valid.
+const presignTTL = 15 * time.Minute
+
+// S3Storage is a Storage backed by an S3-compatible bucket, signed with
+// AWS Signature Version 4 by hand (no AWS SDK dependency is vendored in
+// this module).
+type S3Storage struct {
+	cfg s3Config
+}
+
+func NewS3Storage(cfg s3Config) *S3Storage { return &S3Storage{cfg: cfg} }
+
+func (s *S3Storage) objectURL(key string) string {
+	return strings.TrimRight(s.cfg.endpoint, "/") + "/" + s.cfg.bucket + "/" + pathEscapeKey(key)
+}
+
+func pathEscapeKey(key string) string {
+	var parts []string
+	for _, seg := range strings.Split(key, "/") {
+		parts = append(parts, url.PathEscape(seg))
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s *S3Storage) Put(key string, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeFor(key))
+	req.Header.Set("Cache-Control", cacheControlFor(key))
+	if err := signV4(req, body, s.cfg); err != nil {
+		return err
+	}
+	return doS3(req, http.StatusOK)
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := signV4(req, nil, s.cfg); err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 get %s: status %s", key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	if err := signV4(req, nil, s.cfg); err != nil {
+		return err
+	}
+	return doS3(req, http.StatusNoContent)
+}
+
+// listBucketResult is the subset of ListObjectsV2's XML response we need.
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	u := strings.TrimRight(s.cfg.endpoint, "/") + "/" + s.cfg.bucket + "?list-type=2&prefix=" + url.QueryEscape(prefix)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := signV4(req, nil, s.cfg); err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 list %s: status %s", prefix, resp.Status)
+	}
+	var result listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(result.Contents))
+	for i, c := range result.Contents {
+		keys[i] = c.Key
+	}
+	return keys, nil
+}
+
+// URL returns a presigned GET URL valid for presignTTL, which is what
+// hlsHandler redirects clients to for segment fetches; manifests are always
+// served through hlsHandler.
+func (s *S3Storage) URL(key string) string {
+	u, err := presignV4(http.MethodGet, s.objectURL(key), s.cfg, presignTTL)
+	if err != nil {
+		// fall back to an unsigned URL; a misconfigured bucket will 403 and
+		// that's a clearer signal than silently swallowing the error here
+		return s.objectURL(key)
+	}
+	return u
+}
+
+func doS3(req *http.Request, want int) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("s3 %s %s: status %s: %s", req.Method, req.URL, resp.Status, body)
+	}
+	return nil
+}
+
+// --- AWS Signature Version 4 (hand-rolled: no AWS SDK is vendored here) ---
+
+const awsDateFormat = "20060102T150405Z"
+
+func signV4(req *http.Request, body []byte, cfg s3Config) error {
+	now := time.Now().UTC()
+	amzDate := now.Format(awsDateFormat)
+	dateStamp := now.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("Host", req.URL.Host)
+	req.Host = req.URL.Host
+
+	signedHeaders, canonicalHeaders := canonicalizeHeaders(req.Header, []string{"host", "x-amz-content-sha256", "x-amz-date"})
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, cfg.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := v4SigningKey(cfg.secretKey, dateStamp, cfg.region)
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.accessKey, credentialScope, signedHeaders, signature,
+	))
+	return nil
+}
+
+// presignV4 builds a query-string-signed URL (the form browsers/players can
+// fetch directly, no Authorization header needed).
+func presignV4(method, rawURL string, cfg s3Config, ttl time.Duration) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format(awsDateFormat)
+	dateStamp := now.Format("20060102")
+	credentialScope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, cfg.region)
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", cfg.accessKey+"/"+credentialScope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = q.Encode()
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI(u.Path),
+		canonicalQuery(u.Query()),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := v4SigningKey(cfg.secretKey, dateStamp, cfg.region)
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	q.Set("X-Amz-Signature", signature)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func v4SigningKey(secret, dateStamp, region string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secret), dateStamp)
+	kRegion := hmacSHA256(kDate, region)
+	kService := hmacSHA256(kRegion, "s3")
+	return hmacSHA256(kService, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func canonicalURI(p string) string {
+	if p == "" {
+		p = "/"
+	}
+	return path.Clean("/" + p)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func canonicalizeHeaders(h http.Header, include []string) (signedHeaders, canonicalHeaders string) {
+	sort.Strings(include)
+	var canon strings.Builder
+	for _, name := range include {
+		canon.WriteString(name)
+		canon.WriteString(":")
+		canon.WriteString(strings.TrimSpace(h.Get(name)))
+		canon.WriteString("\n")
+	}
+	return strings.Join(include, ";"), canon.String()
+}
@@ -0,0 +1,438 @@
+// tus.go
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusResumable       = "1.0.0"
+	uploadExpiry       = 24 * time.Hour   // abandoned uploads are eligible for cleanup after this
+	uploadReapInterval = 15 * time.Minute // how often reapLoop sweeps for expired uploads
+	checksumAlgorithm  = "sha1"           // the only Upload-Checksum algorithm this server supports
+)
+
+// uploads is the process-wide tus upload store.
+var uploads *UploadStore
+
+// uploadState is the JSON sidecar tus.go keeps next to each partial upload,
+// so an in-progress upload survives a server restart.
+type uploadState struct {
+	ID       string            `json:"id"`
+	Offset   int64             `json:"offset"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Checksum string            `json:"checksum,omitempty"` // hex sha1 the client declared at creation, verified once the upload completes
+	Owner    string            `json:"owner,omitempty"`    // "sub" claim of the token that created this upload; see revokeHandler
+	Expiry   time.Time         `json:"expiry"`
+	Done     bool              `json:"done"`
+}
+
+// UploadStore tracks in-progress tus uploads, keyed by upload ID, mirroring
+// how Manager tracks in-progress transcodes keyed by videoID+profile.
+type UploadStore struct {
+	dir string // storageDir; each upload gets storageDir/{id} just like a video does
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // per-upload lock, held for the duration of a PATCH
+}
+
+// NewUploadStore returns an UploadStore rooted at dir and starts its
+// background reaper.
+func NewUploadStore(dir string) *UploadStore {
+	s := &UploadStore{dir: dir, locks: make(map[string]*sync.Mutex)}
+	go s.reapLoop()
+	return s
+}
+
+func (s *UploadStore) lockFor(id string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	return l
+}
+
+func (s *UploadStore) uploadDir(id string) string { return filepath.Join(s.dir, id) }
+func (s *UploadStore) partialPath(id string) string {
+	return filepath.Join(s.uploadDir(id), "upload.partial")
+}
+func (s *UploadStore) statePath(id string) string {
+	return filepath.Join(s.uploadDir(id), "upload.json")
+}
+
+// create starts a new upload of the given total length and returns its
+// state. checksum is the hex sha1 the client declared for the completed
+// upload via Upload-Checksum, or "" if it didn't send one. owner is the
+// "sub" claim of the uploader's token, recorded so only they can later
+// revoke this video's playback tokens (see revokeHandler).
+func (s *UploadStore) create(length int64, metadata map[string]string, checksum, owner string) (*uploadState, error) {
+	id := randomID(12)
+	if err := os.MkdirAll(s.uploadDir(id), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(s.partialPath(id))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	st := &uploadState{
+		ID:       id,
+		Length:   length,
+		Metadata: metadata,
+		Checksum: checksum,
+		Owner:    owner,
+		Expiry:   time.Now().Add(uploadExpiry),
+	}
+	if err := s.save(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *UploadStore) load(id string) (*uploadState, error) {
+	data, err := os.ReadFile(s.statePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var st uploadState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *UploadStore) save(st *uploadState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.statePath(st.ID), data, 0o644)
+}
+
+// appendAt writes r to the partial file starting at offset, then persists
+// the new offset in st. The caller must hold lockFor(st.ID).
+func (s *UploadStore) appendAt(st *uploadState, offset int64, r io.Reader) error {
+	f, err := os.OpenFile(s.partialPath(st.ID), os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	st.Offset = offset + n
+	if err != nil {
+		_ = s.save(st) // persist the partial write even on error, so retries resume correctly
+		return err
+	}
+	return s.save(st)
+}
+
+// reapLoop removes upload directories that were abandoned before finishing:
+// past their Expiry and never marked Done. Mirrors Manager.reapLoop and
+// LiveManager.reapLoop for other long-lived resources.
+func (s *UploadStore) reapLoop() {
+	ticker := time.NewTicker(uploadReapInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reapExpired()
+	}
+}
+
+func (s *UploadStore) reapExpired() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id := e.Name()
+		st, err := s.load(id)
+		if err != nil || st.Done || now.Before(st.Expiry) {
+			continue
+		}
+
+		lock := s.lockFor(id)
+		lock.Lock()
+		// re-check under the lock: a PATCH may have raced us and completed
+		// the upload while we were scanning the directory
+		if st, err := s.load(id); err == nil && !st.Done && now.After(st.Expiry) {
+			if err := os.RemoveAll(s.uploadDir(id)); err != nil {
+				log.Printf("tus: reap upload %s: %v", id, err)
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+// tusCreateHandler implements the tus creation extension: POST /files with
+// Upload-Length and (optionally) Upload-Metadata returns a Location the
+// client PATCHes chunks to.
+func tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "upload exceeds max size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if filename, ok := metadata["filename"]; ok && !isAllowedExt(filename) {
+		http.Error(w, "only mp4/mov/mkv/webm allowed", http.StatusBadRequest)
+		return
+	}
+
+	var checksum string
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		var err error
+		checksum, err = parseUploadChecksum(header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	st, err := uploads.create(length, metadata, checksum, subFromContext(r))
+	if err != nil {
+		http.Error(w, "could not create upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.Header().Set("Location", "/files/"+st.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// validUploadID reports whether id is safe to use as a path component under
+// storageDir: non-empty, no "." or "..", and not a "/"-containing path
+// (randomID(12) always produces a flat hex string, so anything else is
+// either a mistake or an attempt to escape storageDir via filepath.Join).
+func validUploadID(id string) bool {
+	return id != "" && id != "." && id != ".." && filepath.Base(id) == id
+}
+
+// tusResumeHandler dispatches HEAD (offset query) and PATCH (append chunk)
+// requests for an existing upload at /files/{id}.
+func tusResumeHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+	if !validUploadID(id) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		tusHeadHandler(w, r, id)
+	case http.MethodPatch:
+		tusPatchHandler(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func tusHeadHandler(w http.ResponseWriter, r *http.Request, id string) {
+	st, err := uploads.load(id)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(st.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatchHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "unsupported Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	lock := uploads.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	st, err := uploads.load(id)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if st.Done {
+		http.Error(w, "upload already completed", http.StatusForbidden)
+		return
+	}
+	if offset != st.Offset {
+		// tus requires the client's notion of the offset to match ours exactly
+		http.Error(w, fmt.Sprintf("offset mismatch: have %d, got %d", st.Offset, offset), http.StatusConflict)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, st.Length-st.Offset)
+	if err := uploads.appendAt(st, offset, body); err != nil {
+		http.Error(w, "write error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+
+	if st.Offset < st.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	playlistURL, err := finishUpload(st)
+	if err != nil {
+		log.Printf("finish upload %s: %v", st.ID, err)
+		http.Error(w, "transcode error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Not IP-bound: this token is handed back to the uploader to
+	// redistribute to viewers (Upload-Playback-Token/Upload-Playlist-URL),
+	// so it must work from whatever address each viewer plays it back
+	// from, not just the uploader's.
+	token, err := mintPlaybackToken(st.ID, "")
+	if err != nil {
+		log.Printf("mint playback token for %s: %v", st.ID, err)
+		http.Error(w, "playback token error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Playlist-URL", playlistURL+"?token="+token)
+	w.Header().Set("Upload-Playback-Token", token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload runs once an upload's offset reaches its length: it moves
+// the completed partial file into place as the video's source and probes
+// it to write master.m3u8, exactly like the old single-shot upload did.
+// Actual per-profile transcoding still happens lazily, via Manager.
+func finishUpload(st *uploadState) (string, error) {
+	outDir := uploads.uploadDir(st.ID)
+	ext := filepath.Ext(st.Metadata["filename"])
+	if ext == "" {
+		ext = ".mp4"
+	}
+	sourcePath := filepath.Join(outDir, "source"+ext)
+	if err := os.Rename(uploads.partialPath(st.ID), sourcePath); err != nil {
+		return "", fmt.Errorf("move upload into place: %w", err)
+	}
+
+	if st.Checksum != "" {
+		got, err := sha1sumFile(sourcePath)
+		if err != nil {
+			return "", fmt.Errorf("checksum upload: %w", err)
+		}
+		if got != st.Checksum {
+			os.Remove(sourcePath)
+			return "", fmt.Errorf("upload checksum mismatch: want sha1 %s, got %s", st.Checksum, got)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+	if err := prepareVideo(ctx, sourcePath, outDir); err != nil {
+		return "", err
+	}
+
+	st.Done = true
+	if err := uploads.save(st); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/hls/%s/master.m3u8", st.ID), nil
+}
+
+// parseUploadChecksum decodes a tus checksum-extension Upload-Checksum
+// header ("algorithm base64digest") and returns the digest as hex, or an
+// error if the algorithm isn't checksumAlgorithm or the digest isn't valid
+// base64.
+func parseUploadChecksum(header string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(header, " ")
+	if !ok {
+		return "", fmt.Errorf("malformed Upload-Checksum: want \"algorithm base64digest\"")
+	}
+	if algorithm != checksumAlgorithm {
+		return "", fmt.Errorf("unsupported checksum algorithm %q: only %s", algorithm, checksumAlgorithm)
+	}
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid Upload-Checksum digest: %w", err)
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+// sha1sumFile returns the hex sha1 of the file at path.
+func sha1sumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// "key base64(value)" pairs, e.g. "filename d29ybGQ=,filetype dmlkZW8vbXA0".
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(strings.TrimSpace(pair))
+		if len(fields) == 0 {
+			continue
+		}
+		key := fields[0]
+		if len(fields) == 1 {
+			metadata[key] = ""
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
@@ -0,0 +1,25 @@
+// tus_test.go
+package main
+
+import "testing"
+
+func TestValidUploadID(t *testing.T) {
+	cases := []struct {
+		id   string
+		want bool
+	}{
+		{"a1b2c3d4e5f6", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../../etc/passwd", false},
+		{"foo/../bar", false},
+		{"foo/bar", false},
+		{"/etc/passwd", false},
+	}
+	for _, c := range cases {
+		if got := validUploadID(c.id); got != c.want {
+			t.Errorf("validUploadID(%q) = %v, want %v", c.id, got, c.want)
+		}
+	}
+}
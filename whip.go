@@ -0,0 +1,78 @@
+// whip.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// whipMaxOfferSize bounds the SDP offer body size; real offers are a few KB.
+const whipMaxOfferSize = 64 * 1024
+
+// whipHandler implements the WHIP (WebRTC-HTTP Ingestion Protocol) publish
+// endpoint at /whip/{streamKey}: POST an SDP offer to start a session,
+// DELETE the same URL to tear it down. Registered behind liveAuth in
+// main(), so both methods require a "live"-scoped bearer token.
+//
+// Live ingest for this backlog is RTMP-only (see rtmp.go): POST here always
+// 501s because negotiateWHIP isn't implemented. DELETE is real — it lets a
+// caller stop a stream it owns over HTTP regardless of which protocol
+// started it — so the route stays registered rather than being pulled
+// entirely.
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	streamKey := strings.TrimPrefix(r.URL.Path, "/whip/")
+	if streamKey == "" || strings.Contains(streamKey, "/") {
+		http.Error(w, "stream key required: /whip/{streamKey}", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		whipPublish(w, r, streamKey)
+	case http.MethodDelete:
+		if err := liveManager.Stop(streamKey, subFromContext(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func whipPublish(w http.ResponseWriter, r *http.Request, streamKey string) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/sdp" {
+		http.Error(w, "expected Content-Type: application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, whipMaxOfferSize))
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "missing SDP offer body", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := negotiateWHIP(streamKey, string(offer))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+streamKey)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(answer))
+}
+
+// negotiateWHIP would drive ICE/DTLS/SRTP setup for streamKey's session and
+// return the SDP answer, then feed the resulting RTP into liveManager the
+// same way rtmp.go feeds it FLV tags.
+//
+// Not implemented: that needs a WebRTC stack (e.g. pion/webrtc) which isn't
+// vendored in this module yet. The HTTP contract above (offer in, Location
+// + DELETE teardown) is real; only the actual media negotiation is stubbed,
+// so ingest can land here once that dependency is added.
+func negotiateWHIP(streamKey, offer string) (string, error) {
+	return "", fmt.Errorf("WHIP ingest requires a WebRTC backend, not yet wired in")
+}